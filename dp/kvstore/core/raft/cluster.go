@@ -0,0 +1,56 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import "log"
+
+// Cluster is the addresses of every node in a raft cluster, keyed by member id,
+// including this node's own entry. Start uses it to seed the node's initial
+// Configuration; GetRemoteFollowers hands out the ids/addresses Node needs to address
+// Messages to everyone else, see remoteFollowerIDs in confchange.go.
+type Cluster struct {
+	allNodes map[int]string // member id -> addr
+}
+
+// NewCluster builds a Cluster from every member's address, keyed by id.
+func NewCluster(nodes map[int]string) *Cluster {
+	c := &Cluster{allNodes: make(map[int]string, len(nodes))}
+	for id, addr := range nodes {
+		c.allNodes[id] = addr
+	}
+	return c
+}
+
+// GetRemoteFollowers returns the id -> addr of every member other than self.
+func (c *Cluster) GetRemoteFollowers(self int) map[int]string {
+	others := make(map[int]string, len(c.allNodes))
+	for id, addr := range c.allNodes {
+		if id != self {
+			others[id] = addr
+		}
+	}
+	return others
+}
+
+// isLeader reports whether this node currently believes it is the leader.
+func (n *Node) isLeader() bool {
+	return n.statemachine.Current() == LEADER
+}
+
+// isCandidate reports whether this node is currently running a real election.
+func (n *Node) isCandidate() bool {
+	return n.statemachine.Current() == CANDIDATE
+}
+
+// isNotLeader is the common guard on leader-only entry points (Propose,
+// ProposeConfChange, ReadIndex).
+func (n *Node) isNotLeader() bool {
+	return !n.isLeader()
+}
+
+// log prefixes msg with this node's id, so interleaved output from multiple nodes in
+// the same process stays attributable.
+func (n *Node) log(msg string) {
+	log.Printf("[node %v] %v", n.id, msg)
+}
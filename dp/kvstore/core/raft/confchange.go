@@ -0,0 +1,240 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConfChangeType identifies what a ConfChange does to the configuration.
+type ConfChangeType int
+
+const (
+	// AddNode adds a new voting member.
+	AddNode ConfChangeType = iota
+	// RemoveNode removes a voting member, possibly the current leader itself - see
+	// Node.ProposeConfChange and maybeAdvanceConfChange for how that corner case is handled.
+	RemoveNode
+)
+
+// ConfChange describes one membership change, proposed through Node.ProposeConfChange
+// and carried to every node as the target Configuration of a log entry.
+type ConfChange struct {
+	Type ConfChangeType
+	ID   int
+	Addr string
+}
+
+// Configuration is one set of voting members and their addresses, used for election
+// and commit quorum math. While a ConfChange is in flight, a node tracks two of
+// them - Node.configuration (the target, Cnew) and Node.jointOld (the configuration
+// it is moving away from) - and requires an independent majority from each, see
+// RAFT paper §6 "Cluster membership changes" / Ongaro's dissertation §4.3.
+type Configuration struct {
+	Members map[int]string // member id -> addr
+}
+
+// newConfiguration builds a Configuration with the given member ids and no known
+// addresses, for the member ids Start takes from a Cluster or a Snapshot carries.
+func newConfiguration(ids []int) *Configuration {
+	c := &Configuration{Members: make(map[int]string, len(ids))}
+	for _, id := range ids {
+		c.Members[id] = ""
+	}
+	return c
+}
+
+// clone returns a deep copy, so building a target configuration never mutates the one
+// still in effect.
+func (c *Configuration) clone() *Configuration {
+	out := &Configuration{Members: make(map[int]string, len(c.Members))}
+	for id, addr := range c.Members {
+		out.Members[id] = addr
+	}
+	return out
+}
+
+// ids returns every member id, for capturing ClusterConfig on a Snapshot.
+func (c *Configuration) ids() []int {
+	ids := make([]int, 0, len(c.Members))
+	for id := range c.Members {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// quorum is the size of a majority of this configuration.
+func (c *Configuration) quorum() int {
+	return len(c.Members)/2 + 1
+}
+
+// majority reports whether acked contains a majority of this configuration's members.
+func (c *Configuration) majority(acked map[int]bool) bool {
+	count := 0
+	for id := range c.Members {
+		if acked[id] {
+			count++
+		}
+	}
+	return count >= c.quorum()
+}
+
+// remoteFollowerIDs returns every member id other than this node's own, across
+// whichever configuration(s) are currently active - both halves of a joint
+// configuration while a ConfChange is in flight.
+func (n *Node) remoteFollowerIDs() []int {
+	seen := map[int]bool{n.id: true}
+	ids := make([]int, 0, len(n.configuration.Members))
+	for id := range n.configuration.Members {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if n.jointOld != nil {
+		for id := range n.jointOld.Members {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// hasQuorum reports whether acked, together with this node itself, forms a majority
+// of every currently active configuration. During a joint phase that means a
+// majority of Cold AND a majority of Cnew independently - a simple combined count is
+// not safe, see the doc on Configuration.
+func (n *Node) hasQuorum(acked map[int]bool) bool {
+	withSelf := make(map[int]bool, len(acked)+1)
+	for id := range acked {
+		withSelf[id] = true
+	}
+	withSelf[n.id] = true
+
+	if !n.configuration.majority(withSelf) {
+		return false
+	}
+	if n.jointOld != nil && !n.jointOld.majority(withSelf) {
+		return false
+	}
+	return true
+}
+
+// configMatchIndex returns the highest index N such that a majority of cfg's members
+// (this node's own last log index standing in for its own matchIndex) have
+// replicated at least N.
+func (n *Node) configMatchIndex(cfg *Configuration) int {
+	indexes := make([]int, 0, len(cfg.Members))
+	for id := range cfg.Members {
+		if id == n.id {
+			indexes = append(indexes, n.replicatedLog.LastIndex())
+			continue
+		}
+		indexes = append(indexes, n.matchIndex[id])
+	}
+	for i := len(indexes); i < cfg.quorum(); i++ {
+		indexes = append(indexes, 0) // a config member we have no matchIndex for yet has replicated nothing
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	return indexes[cfg.quorum()-1]
+}
+
+// recomputeConfiguration rebuilds the active (and, mid-joint-phase, joint)
+// configuration by replaying every ConfChange entry still in the log over
+// baseConfiguration. Needed after Truncate discards a conflicting suffix (see
+// §5.3), since that can revert a configuration change this node had already
+// adopted the instant it was appended.
+func (n *Node) recomputeConfiguration() {
+	var old *Configuration
+	cur := n.baseConfiguration
+
+	for _, entry := range n.replicatedLog.From(n.replicatedLog.FirstIndex()) {
+		switch entry.Type {
+		case EntryConfChangeJoint:
+			old = cur
+			cur = entry.Conf
+		case EntryConfChangeFinal:
+			old = nil
+			cur = entry.Conf
+		}
+	}
+
+	n.jointOld = old
+	n.configuration = cur
+}
+
+// ProposeConfChange appends cc as a new joint (Cold,new) configuration entry, if this
+// node is currently the leader and no other configuration change is already in
+// flight. Like any other log entry, the configuration takes effect immediately on
+// this node rather than waiting for it to commit; it stays in its joint phase -
+// requiring majorities of both Cold and Cnew - until maybeAdvanceConfChange appends
+// the matching Cnew-only entry.
+func (n *Node) ProposeConfChange(cc ConfChange) (index int, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.isNotLeader() {
+		return 0, fmt.Errorf("node %v is not the leader", n.id)
+	}
+	if n.confChangeIndex != 0 {
+		return 0, fmt.Errorf("node %v: a configuration change is already in progress", n.id)
+	}
+
+	target := n.configuration.clone()
+	switch cc.Type {
+	case AddNode:
+		target.Members[cc.ID] = cc.Addr
+	case RemoveNode:
+		delete(target.Members, cc.ID)
+	}
+
+	entry := LogEntry{Term: n.currentTerm, Index: n.replicatedLog.LastIndex() + 1, Type: EntryConfChangeJoint, Conf: target}
+	n.replicatedLog.Append(entry)
+	n.toPersist = append(n.toPersist, entry)
+
+	n.jointOld = n.configuration
+	n.configuration = target
+	n.confChangeIndex = entry.Index
+	change := cc
+	n.pendingChange = &change
+
+	n.signalReady()
+	return entry.Index, nil
+}
+
+// maybeAdvanceConfChange drives the leader side of joint consensus once commitIndex
+// advances. Once the Cold,new entry commits, it immediately appends the Cnew-only
+// entry that ends the joint phase; once that entry commits in turn, if this node was
+// the one removed, it steps down - only now, never before Cnew is safely committed,
+// so a premature step-down can never strand the cluster without a leader.
+func (n *Node) maybeAdvanceConfChange() {
+	if n.confChangeIndex == 0 || n.commitIndex < n.confChangeIndex {
+		return
+	}
+	entry, ok := n.replicatedLog.Get(n.confChangeIndex)
+	if !ok {
+		return
+	}
+
+	switch entry.Type {
+	case EntryConfChangeJoint:
+		final := LogEntry{Term: n.currentTerm, Index: n.replicatedLog.LastIndex() + 1, Type: EntryConfChangeFinal, Conf: n.configuration}
+		n.replicatedLog.Append(final)
+		n.toPersist = append(n.toPersist, final)
+		n.jointOld = nil
+		n.confChangeIndex = final.Index
+
+	case EntryConfChangeFinal:
+		removed := n.pendingChange
+		n.confChangeIndex = 0
+		n.pendingChange = nil
+		if removed != nil && removed.Type == RemoveNode && removed.ID == n.id {
+			n.log("Removed self via ConfChange. Stepping down.")
+			n.switchToFollower()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+// MessageType identifies the kind of Message exchanged between raft nodes and the
+// local clock, following the naming used by etcd/raft's raw node.
+type MessageType int
+
+const (
+	// MsgTick is delivered by the caller once per logical clock tick, see Node.Tick.
+	MsgTick MessageType = iota
+	// MsgProp carries a command a client wants appended to the log, see Node.Propose.
+	MsgProp
+	// MsgVote and MsgVoteResp are the real RequestVote RPC and its reply.
+	MsgVote
+	MsgVoteResp
+	// MsgPreVote and MsgPreVoteResp probe for a pre-vote without mutating currentTerm
+	// or votedFor, see the PRE_CANDIDATE state in Statemachine.
+	MsgPreVote
+	MsgPreVoteResp
+	// MsgApp and MsgAppResp are AppendEntries carrying one or more log entries.
+	MsgApp
+	MsgAppResp
+	// MsgHeartbeat and MsgHeartbeatResp are an empty AppendEntries, used purely to
+	// assert leadership and advance commitIndex between log-carrying rounds.
+	MsgHeartbeat
+	MsgHeartbeatResp
+	// MsgSnap and MsgSnapResp stream one chunk of a Snapshot to a follower that has
+	// fallen too far behind to catch up via MsgApp, see stepInstallSnapshot.
+	MsgSnap
+	MsgSnapResp
+)
+
+// Message is the single format every raft interaction is expressed in - a peer RPC, a
+// peer's reply, or a tick of the local clock - so that Step can run single-threaded
+// with no network call or timer of its own; the transport only ever reads outbound
+// Messages off Ready and feeds received ones back in via Step.
+type Message struct {
+	Type MessageType
+	From int // sender; on messages this node produces, always n.id
+	To   int // recipient, addressed by member id in the active Configuration
+
+	Term int
+
+	// LogIndex/LogTerm double up depending on Type: prevLogIndex/prevLogTerm on
+	// MsgApp, lastLogIndex/lastLogTerm on MsgVote/MsgPreVote, the follower's new last
+	// index on a successful MsgAppResp, and LastIncludedIndex/Term on MsgSnap(Resp).
+	LogIndex int
+	LogTerm  int
+
+	Commit  int        // leaderCommit, carried on MsgApp/MsgHeartbeat
+	Entries []LogEntry // MsgApp payload
+
+	Command string // MsgProp payload
+
+	Data          []byte // MsgSnap chunk payload
+	Offset        int    // MsgSnap chunk offset
+	Done          bool   // MsgSnap: true on the final chunk
+	ClusterConfig []int  // MsgSnap: member ids as of the snapshot, carried on the final chunk
+
+	ReadSeq int // ReadIndex round a MsgHeartbeat(Resp)/MsgApp(Resp) belongs to, see ackRead
+
+	Reject bool // set on a *Resp message that failed
+}
@@ -2,11 +2,16 @@
 // Licensed under the Apache License, Version 2.0
 
 // Package raft is an implementation of the RAFT consensus algorithm.
+//
+// Only the tree from the chunk0-5 message-driven Step/Tick refactor onward is expected
+// to build and pass go vet/go test; the chunk0-1 through chunk0-4 commits were
+// incremental steps toward it and do not individually compile (no more than the
+// baseline they were built on did) - check out HEAD rather than one of those commits
+// if you need this package to build.
 package raft
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
 	"sync"
 	"time"
@@ -14,19 +19,69 @@ import (
 
 // Node is a node in a Raft consensus cluster. It is called "server" in the original Raft paper.
 // Node seems to be more accurate because we can run multiple nodes in a single server process.
+//
+// Node is driven entirely through Step and Tick: it makes no RPC calls and runs no
+// timers of its own. A transport loop feeds received Messages in via Step, ticks the
+// clock via Tick, and drains whatever Step/Tick produced from Ready - see step.go.
 type Node struct {
-	id             int
-	statemachine   *Statemachine
-	replicatedLog  *ReplicatedLog
-	electionTimer  timercontrol // runs only if the node is FOLLOWER or CANDIDATE
-	heartbeatTimer timercontrol // runs only if the node is in LEADER state
-	currentTerm    int
-	votedFor       *int
-	cluster        *Cluster // our cluster
-	stopped        bool     // helper to simulate stopped nodes
-	mutex          sync.Mutex
+	id            int
+	statemachine  *Statemachine
+	replicatedLog *ReplicatedLog
+	currentTerm   int
+	votedFor      *int
+	cluster       *Cluster // our cluster
+	stopped       bool     // helper to simulate stopped nodes
+
+	electionElapsed  int // ticks since the last election-relevant contact
+	heartbeatElapsed int // leader only: ticks since the last heartbeat round
+	electionTimeout  int // randomized per node, and again on every election timeout, see tick
+	heartbeatTimeout int
+
+	commitIndex int // index of the highest log entry known to be committed
+	lastApplied int // index of the highest log entry applied to toApply/Ready
+
+	nextIndex  map[int]int // leader only: next log index to send to each follower, keyed by member id in the active Configuration
+	matchIndex map[int]int // leader only: highest log index known to be replicated on each follower, same keying
+
+	votesGranted    map[int]bool // candidate only: member ids that granted the real vote this term
+	preVotesGranted map[int]bool // pre-candidate only: member ids that granted a pre-vote
+
+	baseConfiguration *Configuration // configuration in effect before the log's first entry (from Start, or the last snapshot)
+	configuration     *Configuration // active configuration - Cnew while a joint change is in flight, else the sole configuration
+	jointOld          *Configuration // non-nil only while a ConfChange is in its joint (Cold,new) phase, see ProposeConfChange
+	confChangeIndex   int            // log index of the in-flight ConfChange entry not yet resolved, see maybeAdvanceConfChange
+	pendingChange     *ConfChange    // the change being applied, to detect a leader removing itself once Cnew commits
+
+	leaderID *int // id of the last known leader, for ReadIndex redirects
+
+	readOnlyOption ReadOnlyOption
+	lastQuorumAck  time.Time             // leader only: last time a ReadIndex-tagged heartbeat round got a majority of acks; plain rounds are not tracked
+	pendingReads   []pendingRead         // leader only: ReadIndex calls waiting for the next heartbeat round
+	readsBySeq     map[int][]pendingRead // leader only: reads tagged onto an in-flight heartbeat round
+	readAcks       map[int]map[int]bool  // leader only: member ids that have acked each in-flight round
+	readSeq        int                   // leader only: last round number handed out
+
+	snapshot        *Snapshot // most recent snapshot, created locally or installed from a leader
+	snapshotStore   SnapshotStore
+	inboundSnapshot []byte      // chunks received so far for an InstallSnapshot in progress
+	snapshotOffset  map[int]int // leader only: byte offset streamed so far to each follower
+
+	outMessages     []Message  // queued for the next Ready
+	toPersist       []LogEntry // newly appended entries queued for the next Ready
+	toApply         []LogEntry // newly committed entries queued for the next Ready
+	pendingSnapshot *Snapshot  // set once, for the next Ready, when a snapshot was just installed
+	readyCh         chan Ready
+
+	mutex sync.Mutex
 }
 
+// electionTimeoutFloor is the minimum real-time gap ReadIndex's LeaseBased option
+// trusts a prior quorum ack to still be valid for, regardless of how many ticks the
+// node's own clock has counted off since - see ReadIndex. PreVote has no
+// equivalent real-time floor; it runs entirely on the node's tick-counted
+// electionElapsed/electionTimeout, see stepPreVote.
+const electionTimeoutFloor = 2000 * time.Millisecond
+
 // NewNode constructor. Id starts with 0 for the first node and should be +1 for the next node.
 func NewNode(id int) *Node {
 	node := new(Node)
@@ -35,250 +90,266 @@ func NewNode(id int) *Node {
 	node.votedFor = nil
 	node.statemachine = NewStatemachine()
 	node.replicatedLog = NewReplicatedLog()
+	node.readyCh = make(chan Ready, 1)
+
+	node.electionTimeout = 20 + rand.Intn(10) // ticks; jittered so nodes rarely time out together
+	node.heartbeatTimeout = 10                // ticks
 
-	node.electionTimer = createPeriodicTimer(
-		func() time.Duration {
-			return time.Duration(2000+rand.Intn(1000)) * time.Millisecond
-		},
-		func() { node.electionTimeout() })
-
-	node.heartbeatTimer = createPeriodicTimer(
-		func() time.Duration {
-			return time.Duration(1000) * time.Millisecond
-		},
-		func() { node.heatbeatTimeout() })
 	return node
 }
 
-// Start starts the node and the election timer. The cluster are the remote interfaces of all other nodes.
+// Start starts the node. The cluster holds the addresses of every member, this node
+// included; on first start its member ids seed the node's configuration.
 func (n *Node) Start(cluster *Cluster) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
 	n.stopped = false
 	n.cluster = cluster
-	n.electionTimer.resetC <- true
+	n.electionElapsed = 0
+
+	if n.configuration == nil {
+		ids := []int{n.id}
+		for i := range cluster.GetRemoteFollowers(n.id) {
+			ids = append(ids, i)
+		}
+		n.baseConfiguration = newConfiguration(ids)
+		n.configuration = n.baseConfiguration
+	}
 }
 
-// Stop stops all running timers and switch to follower state.
+// Stop stops the node and switches it to follower state.
 func (n *Node) Stop() {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
 	n.stopped = true
-	n.heartbeatTimer.stopC <- true
-	n.electionTimer.stopC <- true
-	n.statemachine.Next(FOLLOWER)
+	if n.statemachine.Current() != FOLLOWER {
+		n.statemachine.Next(FOLLOWER)
+	}
 }
 
-// =====================================================================================================================
-// Election
-// =====================================================================================================================
-
-// ElectionTimeout happens when a node receives no heartbeat in a given time period.
-func (n *Node) electionTimeout() {
+// Propose appends cmd to the log as a new entry, if this node is currently the
+// leader. The entry is replicated to followers on the next heartbeat and surfaced on
+// Ready's EntriesToApply once a majority of the cluster has it. Propose returns the
+// index the entry was given.
+func (n *Node) Propose(cmd string) (index int, err error) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
-	// make shutdown safe
-	if n.stopped {
-		return
+	if n.isNotLeader() {
+		return 0, fmt.Errorf("node %v is not the leader", n.id)
 	}
 
-	n.log(fmt.Sprintf("Election timout."))
-	if n.isLeader() {
-		panic("The election timeout should not happen, when a node is LEADER.")
-	}
-	n.startElectionProcess()
+	index = n.stepPropose(cmd)
+	n.signalReady()
+	return index, nil
 }
 
-// StartElectionProcess sends a RequestVote request to other members in the cluster.
-// if successful - we get are the new leader in a new term.
+// =====================================================================================================================
+// Election
+// =====================================================================================================================
+
+// startElectionProcess begins a new PreVote round; only once a majority of pre-votes
+// are granted does the node actually bump currentTerm and run a real election, see
+// stepPreVoteResp. hasQuorum counts this node's own pre-vote/vote whether or not any
+// remote follower exists, so a single-node configuration wins its pre-vote (and then
+// its election, see maybeWinPreVote) the instant it is broadcast.
 func (n *Node) startElectionProcess() {
-	n.currentTerm++ // new term starts now -> see 5.2
-	n.statemachine.Next(CANDIDATE)
-	n.votedFor = nil
-	electionWon := n.executeElection()
-	if electionWon {
-		n.log(fmt.Sprintf("Election won. Now acting as leader."))
-		n.switchToLeader()
-	} else {
-		n.log(fmt.Sprintf("Election was not won. Reset election timer"))
-		n.statemachine.Next(FOLLOWER)
-		n.electionTimer.resetC <- true // try again, split vote or cluster down
-	}
+	n.statemachine.Next(PRE_CANDIDATE)
+	n.preVotesGranted = make(map[int]bool)
+	n.log("-> PreVote")
+	n.broadcastPreVoteRequests()
+	n.maybeWinPreVote()
 }
 
-// ExecuteElection executes a leader election by sending RequestVote to other nodes.
-// for all other nodes in the cluster RequestVote is sent
-func (n *Node) executeElection() bool {
-	n.log("-> Election")
-	n.votedFor = &n.id // vote for ourself
-
-	var wg sync.WaitGroup
-	nodes := n.cluster.GetRemoteFollowers(n.id)
-	votes := make([]bool, len(nodes))
-	wg.Add(len(nodes))
-	for i, rpcIf := range nodes {
-		go func(w *sync.WaitGroup, i int, rpcIf NodeRPC) {
-			term, ok := rpcIf.RequestVote(n.currentTerm, n.id, 0, 0)
-			if term > n.currentTerm {
-				// todo
-			}
-			votes[i] = ok
-			w.Done()
-		}(&wg, i, rpcIf)
-	}
-	wg.Wait() // wait until all nodes have voted
+// broadcastPreVoteRequests probes every follower with term = currentTerm+1, without
+// yet incrementing currentTerm or clearing votedFor, following etcd/raft's
+// StatePreCandidate design.
+func (n *Node) broadcastPreVoteRequests() {
+	probeTerm := n.currentTerm + 1
+	lastLogIndex := n.replicatedLog.LastIndex()
+	lastLogTerm := n.replicatedLog.LastTerm()
 
-	// Count votes
-	nbrOfVotes := 1 // master votes for itself!
-	for _, vote := range votes {
-		if vote {
-			nbrOfVotes++
-		}
+	for _, id := range n.remoteFollowerIDs() {
+		n.send(Message{Type: MsgPreVote, From: n.id, To: id, Term: probeTerm, LogIndex: lastLogIndex, LogTerm: lastLogTerm})
 	}
-	// If more than 50% respond with true - The election was won!
-	electionWon := nbrOfVotes >= len(n.cluster.allNodes)/2+1
-	n.log(fmt.Sprintf("<- Election: %v", electionWon))
-	return electionWon
 }
 
-// SwitchToLeader does the state change from CANDIDATE to LEADER.
-func (n *Node) switchToLeader() {
-	n.statemachine.Next(LEADER)
-	n.heartbeatTimer.resetC <- true
-	n.electionTimer.stopC <- true
-}
-
-// =====================================================================================================================
-// Leader only functions
-// =====================================================================================================================
-
-// heatbeatTimeout sends the heartbeat to all other nodes in the cluster parallel.
-func (n *Node) heatbeatTimeout() {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+// broadcastVoteRequests starts the real election, once the pre-vote proved it would
+// be won.
+func (n *Node) broadcastVoteRequests() {
+	lastLogIndex := n.replicatedLog.LastIndex()
+	lastLogTerm := n.replicatedLog.LastTerm()
 
-	// make shutdown safe
-	if n.stopped {
-		return
-	}
-
-	if n.isNotLeader() {
-		panic("sendHeartbeat should only run in LEADER state!")
+	for _, id := range n.remoteFollowerIDs() {
+		n.send(Message{Type: MsgVote, From: n.id, To: id, Term: n.currentTerm, LogIndex: lastLogIndex, LogTerm: lastLogTerm})
 	}
+}
 
-	n.log("-> Heartbeat")
+// switchToLeader does the state change from CANDIDATE to LEADER and sends the first
+// heartbeat round immediately.
+func (n *Node) switchToLeader() {
+	n.statemachine.Next(LEADER)
 
-	var wg sync.WaitGroup
-
-	nodes := n.cluster.GetRemoteFollowers(n.id)
-
-	result := make([]bool, len(nodes))
-	wg.Add(len(nodes))
-	for i, rpcIf := range nodes {
-		func(w *sync.WaitGroup, i int, nodeRPC NodeRPC) {
-			term, ok := nodeRPC.AppendEntries(n.currentTerm, n.id, 0, 0, nil, 0)
-			// See §5.1
-			if term > n.currentTerm {
-				n.switchToFollower()
-			}
-			result[i] = ok
-			w.Done()
-		}(&wg, i, rpcIf)
+	lastIndex := n.replicatedLog.LastIndex()
+	followers := n.remoteFollowerIDs()
+	n.nextIndex = make(map[int]int, len(followers))
+	n.matchIndex = make(map[int]int, len(followers))
+	for _, id := range followers {
+		n.nextIndex[id] = lastIndex + 1
+		n.matchIndex[id] = 0
 	}
-	wg.Wait() // wait until all nodes have voted
+	n.votesGranted = nil
+	n.preVotesGranted = nil
+	n.leaderID = &n.id
 
-	n.log("<- Heartbeat")
+	n.heartbeatElapsed = 0
+	n.broadcastHeartbeat()
 }
 
-// SwitchToFollower switches a LEADER or CANDIDATE to the follower state
+// switchToFollower switches a LEADER, CANDIDATE or PRE_CANDIDATE to the follower state.
 func (n *Node) switchToFollower() {
 	if n.isLeader() {
-		n.heartbeatTimer.stopC <- true
+		// any ReadIndex calls we could not yet prove are abandoned; callers must
+		// notice via their own ctx and retry against the new leader.
+		n.pendingReads = nil
+		n.readsBySeq = nil
+		n.readAcks = nil
 		n.statemachine.Next(FOLLOWER)
-	} else if n.isCandidate() {
+	} else if n.isCandidate() || n.statemachine.Current() == PRE_CANDIDATE {
 		n.statemachine.Next(FOLLOWER)
 	}
 }
 
 // =====================================================================================================================
-// Follower RPC - Heartbeat & Replication
+// Leader only functions
 // =====================================================================================================================
 
-// AppendEntries implementation is used as heartbeat and log replication.
-func (n *Node) AppendEntries(term, leaderID, prevLogIndex, prevLogTermin int, entries []string, leaderCommit int) (currentTerm int, success bool) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+// broadcastHeartbeat sends an AppendEntries/heartbeat round to every follower,
+// replicating whatever log entries they are missing, and tags the round with any
+// ReadIndex calls queued since the last one.
+func (n *Node) broadcastHeartbeat() {
+	n.log("-> Heartbeat")
 
-	if n.stopped {
-		return n.currentTerm, false // stopped node
+	seq := 0
+	if len(n.pendingReads) > 0 {
+		n.readSeq++
+		seq = n.readSeq
+		if n.readsBySeq == nil {
+			n.readsBySeq = make(map[int][]pendingRead)
+			n.readAcks = make(map[int]map[int]bool)
+		}
+		n.readsBySeq[seq] = n.pendingReads
+		n.readAcks[seq] = make(map[int]bool) // hasQuorum counts the leader's own ack implicitly
+		n.pendingReads = nil
+		n.resolveRead(seq) // a round that is already its own majority never gets a reply to trigger ackRead
 	}
 
-	if term < n.currentTerm {
-		return n.currentTerm, false // §5.1
+	for _, id := range n.remoteFollowerIDs() {
+		n.sendAppendOrSnapshot(id, seq)
 	}
+}
 
-	// see 5.1 - If one servers term is smaller than the others, then it updates its current term to the larger value.
-	if term > n.currentTerm {
-		n.currentTerm = term
-		if n.isLeader() || n.isCandidate() {
-			n.switchToFollower()
-			return n.currentTerm, false
-		}
+// sendAppendOrSnapshot queues one replication message to follower, switching to
+// snapshot streaming if the entries it needs have already been compacted away.
+func (n *Node) sendAppendOrSnapshot(follower, readSeq int) {
+	nextIdx := n.nextIndex[follower]
+	if nextIdx == 0 {
+		nextIdx = n.replicatedLog.LastIndex() + 1 // a member added since the leader last rebuilt nextIndex
 	}
 
-	// heartbeat received in FOLLOWER -> reset election timer!
-	if entries == nil || len(entries) == 0 {
-		n.log("Heartbeat received. Reset election timer.")
-		n.electionTimer.resetC <- true
-	} else {
-		// todo: replicate logs
-		log.Printf("[%v] AppendEntries replicate logs on Node: %v", n.statemachine.Current(), n.id)
-
+	if n.snapshot != nil && nextIdx < n.replicatedLog.FirstIndex() {
+		n.queueSnapshot(follower)
+		return
 	}
 
-	return n.currentTerm, true
-}
-
-// =====================================================================================================================
-// Follower RPC - Leader Election
-// =====================================================================================================================
-
-// RequestVote is called by candidates to gather votes.
-// It returns the current term to update the candidate
-// It returns true when the candidate received vote.
-func (n *Node) RequestVote(term, candidateID, lastLogIndex, lastLogTerm int) (int, bool) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+	prevLogIndex := nextIdx - 1
+	prevLogTerm := 0
+	if entry, ok := n.replicatedLog.Get(prevLogIndex); ok {
+		prevLogTerm = entry.Term
+	}
+	entries := n.replicatedLog.From(nextIdx)
 
-	// stopped nodes do not vote
-	if n.stopped {
-		return n.currentTerm, false // stopped node
+	msgType := MsgHeartbeat
+	if len(entries) > 0 {
+		msgType = MsgApp
 	}
 
-	n.electionTimer.resetC <- true
+	n.send(Message{
+		Type: msgType, From: n.id, To: follower, Term: n.currentTerm,
+		LogIndex: prevLogIndex, LogTerm: prevLogTerm, Commit: n.commitIndex,
+		Entries: entries, ReadSeq: readSeq,
+	})
+}
 
-	// see RequestVoteRPC receiver implementation 1
-	if term < n.currentTerm {
-		return n.currentTerm, false
+// advanceCommitIndex sets commitIndex to the highest index N such that N is
+// replicated to a majority of every currently active configuration and
+// log[N].term == currentTerm (see §5.4.2 - committing entries from a previous term
+// purely by replication count is unsafe; see configMatchIndex for the joint-consensus
+// majority rule during a ConfChange).
+func (n *Node) advanceCommitIndex() {
+	candidate := n.configMatchIndex(n.configuration)
+	if n.jointOld != nil {
+		if old := n.configMatchIndex(n.jointOld); old < candidate {
+			candidate = old
+		}
 	}
-	// see RequestVoteRPC receiver implementation 2
-	if n.votedFor != nil && term == n.currentTerm {
-		return n.currentTerm, false
+	if candidate <= n.commitIndex {
+		return
 	}
-	// see 5.1 - If one servers term is smaller than the others, then it updates its current term to the larger value.
-	if term > n.currentTerm {
-		n.currentTerm = term
-		if n.isCandidate() || n.isLeader() {
-			n.switchToFollower()
+	if entry, ok := n.replicatedLog.Get(candidate); ok && entry.Term == n.currentTerm {
+		n.commitIndex = candidate
+	}
+}
+
+// applyCommitted queues every entry between lastApplied and commitIndex onto Ready's
+// EntriesToApply, then - on the leader - drives any ConfChange waiting on that commit.
+func (n *Node) applyCommitted() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		if entry, ok := n.replicatedLog.Get(n.lastApplied); ok {
+			n.toApply = append(n.toApply, entry)
 		}
 	}
+	if n.isLeader() {
+		n.maybeAdvanceConfChange()
+	}
+}
 
-	n.votedFor = &candidateID
+// ackRead records one more ack, from id from, for a ReadIndex round, then resolves it
+// via resolveRead once that's enough.
+func (n *Node) ackRead(from, seq int) {
+	if seq == 0 {
+		return
+	}
+	if acked, ok := n.readAcks[seq]; ok {
+		acked[from] = true
+	}
+	n.resolveRead(seq)
+}
 
-	n.log(fmt.Sprintf("RequestVote received from Candidate %v. Vote OK.", candidateID))
+// resolveRead hands every read queued onto round seq its index once the round's acking
+// set forms a majority of every currently active configuration - the same hasQuorum
+// rule elections and commits use, not a combined count against the larger of the two
+// halves (see RAFT paper §6; a combined count would let a majority of Cold alone
+// satisfy a round during a chunk0-6 joint-consensus reconfiguration even without a
+// single Cnew-only ack, breaking the linearizability ReadIndex promises). Called both
+// as acks trickle in via ackRead and immediately after broadcastHeartbeat tags a round -
+// the same maybeWinElection/maybeWinPreVote pattern of checking quorum right after a
+// broadcast - so a round that is already a majority on its own (no remote followers to
+// wait on, including one a joint-consensus RemoveNode just shrank to) resolves without
+// ever needing a reply.
+func (n *Node) resolveRead(seq int) {
+	acked, ok := n.readAcks[seq]
+	if !ok || !n.hasQuorum(acked) {
+		return
+	}
 
-	return n.currentTerm, true
+	n.lastQuorumAck = time.Now()
+	for _, read := range n.readsBySeq[seq] {
+		read.resultCh <- uint64(read.index)
+	}
+	delete(n.readsBySeq, seq)
+	delete(n.readAcks, seq)
 }
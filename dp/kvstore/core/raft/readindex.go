@@ -0,0 +1,90 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReadOnlyOption controls how Node.ReadIndex proves linearizability of a read-only query.
+type ReadOnlyOption int
+
+const (
+	// Safe confirms leadership via a full heartbeat round before returning a read
+	// index, see RAFT paper §6 "Processing read-only queries more efficiently".
+	Safe ReadOnlyOption = iota
+	// LeaseBased trusts that leadership was already confirmed by a heartbeat round
+	// within the last election timeout, skipping the extra round trip. Faster, but
+	// only correct if clock drift between nodes is bounded. Only heartbeat rounds that
+	// carried a ReadIndex call renew the lease; acks of plain heartbeat rounds do not.
+	LeaseBased
+)
+
+// pendingRead is a ReadIndex call waiting for the current heartbeat round to prove
+// this node is still the leader.
+type pendingRead struct {
+	index    int
+	resultCh chan uint64
+}
+
+// SetReadOnlyOption configures how ReadIndex proves linearizability. The zero value, Safe, is the default.
+func (n *Node) SetReadOnlyOption(option ReadOnlyOption) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.readOnlyOption = option
+}
+
+// ReadIndex returns a committed index that the caller must wait for its state machine
+// to apply to before serving a linearizable read, without appending anything to the
+// log. On the leader, in Safe mode this blocks until a majority of nodes have acked
+// the next heartbeat round, proving the leader was still leader when the read was
+// received; in LeaseBased mode it returns immediately if such a round already
+// completed within the last election timeout. Called on anything but the leader, it
+// fails with a hint of the current leader id so the caller can redirect.
+func (n *Node) ReadIndex(ctx context.Context) (uint64, error) {
+	n.mutex.Lock()
+
+	if n.isNotLeader() {
+		leaderHint := -1
+		if n.leaderID != nil {
+			leaderHint = *n.leaderID
+		}
+		n.mutex.Unlock()
+		return 0, fmt.Errorf("node %v is not the leader, redirect to node %v", n.id, leaderHint)
+	}
+
+	if n.readOnlyOption == LeaseBased && time.Since(n.lastQuorumAck) < electionTimeoutFloor {
+		index := uint64(n.commitIndex)
+		n.mutex.Unlock()
+		return index, nil
+	}
+
+	if n.hasQuorum(nil) {
+		// This node is already a majority of every active configuration on its own (a
+		// single-member cluster, or one a joint-consensus RemoveNode just shrank to) -
+		// no remote follower will ever ack a heartbeat round to prove it, so there is
+		// nothing to queue or wait for.
+		index := uint64(n.commitIndex)
+		n.lastQuorumAck = time.Now()
+		n.mutex.Unlock()
+		return index, nil
+	}
+
+	read := pendingRead{index: n.commitIndex, resultCh: make(chan uint64, 1)}
+	n.pendingReads = append(n.pendingReads, read)
+	n.mutex.Unlock()
+
+	select {
+	case index := <-read.resultCh:
+		return index, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Queued reads are handed their index by resolveRead (see node.go), once the heartbeat
+// round they were tagged onto has acks from a majority of every active configuration.
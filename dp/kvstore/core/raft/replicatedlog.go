@@ -0,0 +1,166 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import "sync"
+
+// EntryType distinguishes a normal command entry from the two kinds of membership
+// change entry used by joint consensus, see ConfChange and Node.ProposeConfChange.
+type EntryType int
+
+const (
+	// EntryNormal carries a client command, surfaced on Ready's EntriesToApply once committed.
+	EntryNormal EntryType = iota
+	// EntryConfChangeJoint carries the target Configuration of an in-flight change;
+	// from the moment it is appended, election and commit quorum require a majority
+	// of both the old configuration and this one (Cold,new).
+	EntryConfChangeJoint
+	// EntryConfChangeFinal carries the same Configuration, appended by the leader
+	// once the EntryConfChangeJoint entry commits; from the moment it is appended,
+	// the old configuration is no longer consulted for quorum (Cnew).
+	EntryConfChangeFinal
+)
+
+// LogEntry is a single entry of the replicated log. See RAFT paper figure 2. Conf is
+// only set on the two EntryConfChange* types.
+type LogEntry struct {
+	Term    int
+	Index   int
+	Type    EntryType
+	Command string
+	Conf    *Configuration
+}
+
+// ReplicatedLog is the leader's and each follower's local copy of the raft log,
+// keyed by (term, index) as described in the RAFT paper. Index is 1-based, index 0
+// means "nothing committed yet / no previous entry". baseIndex/baseTerm record the
+// last entry folded into a snapshot, see CreateSnapshot/Reset - entries then holds
+// only what comes after baseIndex.
+type ReplicatedLog struct {
+	mutex     sync.Mutex
+	entries   []LogEntry
+	baseIndex int
+	baseTerm  int
+}
+
+// NewReplicatedLog constructor. Returns an empty log.
+func NewReplicatedLog() *ReplicatedLog {
+	log := new(ReplicatedLog)
+	log.entries = make([]LogEntry, 0)
+	return log
+}
+
+// Append adds entries to the end of the log.
+func (r *ReplicatedLog) Append(entries ...LogEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.entries = append(r.entries, entries...)
+}
+
+// Truncate removes fromIndex and everything after it from the log. Used by followers
+// to discard a conflicting suffix (see §5.3).
+func (r *ReplicatedLog) Truncate(fromIndex int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if fromIndex <= r.baseIndex {
+		r.entries = r.entries[:0]
+		return
+	}
+	offset := fromIndex - r.baseIndex - 1
+	if offset < len(r.entries) {
+		r.entries = r.entries[:offset]
+	}
+}
+
+// Get returns the entry at index, and ok=false if index is out of range or has
+// already been folded into a snapshot.
+func (r *ReplicatedLog) Get(index int) (entry LogEntry, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index <= r.baseIndex || index > r.baseIndex+len(r.entries) {
+		return LogEntry{}, false
+	}
+	return r.entries[index-r.baseIndex-1], true
+}
+
+// From returns a copy of the entries starting at index (inclusive) through the end of
+// the log. A nil slice is returned when index is past the end of the log.
+func (r *ReplicatedLog) From(index int) []LogEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index <= r.baseIndex+1 {
+		index = r.baseIndex + 1
+	}
+	offset := index - r.baseIndex - 1
+	if offset >= len(r.entries) {
+		return nil
+	}
+	out := make([]LogEntry, len(r.entries)-offset)
+	copy(out, r.entries[offset:])
+	return out
+}
+
+// LastIndex returns the index of the last entry in the log, or the snapshot's
+// LastIncludedIndex if nothing has been appended since.
+func (r *ReplicatedLog) LastIndex() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.baseIndex + len(r.entries)
+}
+
+// LastTerm returns the term of the last entry in the log, or the snapshot's
+// LastIncludedTerm if nothing has been appended since.
+func (r *ReplicatedLog) LastTerm() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.entries) == 0 {
+		return r.baseTerm
+	}
+	return r.entries[len(r.entries)-1].Term
+}
+
+// FirstIndex returns the index of the oldest entry still retained in the log (i.e. the
+// next index after the last snapshot, or 1 if nothing has ever been compacted).
+func (r *ReplicatedLog) FirstIndex() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.baseIndex + 1
+}
+
+// DiscardBefore folds everything up to and including index into a snapshot baseline:
+// those entries are removed, and LastIndex/LastTerm fall back to index/term when the
+// log has nothing left. Used by CreateSnapshot to compact the log.
+func (r *ReplicatedLog) DiscardBefore(index, term int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index <= r.baseIndex {
+		return
+	}
+	offset := index - r.baseIndex
+	if offset < len(r.entries) {
+		r.entries = append([]LogEntry(nil), r.entries[offset:]...)
+	} else {
+		r.entries = r.entries[:0]
+	}
+	r.baseIndex = index
+	r.baseTerm = term
+}
+
+// Reset discards the entire log and anchors it right after a just-installed snapshot.
+func (r *ReplicatedLog) Reset(lastIncludedIndex, lastIncludedTerm int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.baseIndex = lastIncludedIndex
+	r.baseTerm = lastIncludedTerm
+	r.entries = r.entries[:0]
+}
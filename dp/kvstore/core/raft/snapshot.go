@@ -0,0 +1,73 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import (
+	"fmt"
+)
+
+// Snapshot is a point-in-time copy of the replicated state machine together with
+// enough raft metadata to resume log replication from it (see §7, log compaction).
+type Snapshot struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	StateMachineBytes []byte
+	ClusterConfig     []int // member ids in effect when the snapshot was taken
+}
+
+// SnapshotStore persists and retrieves snapshots, so a node's latest snapshot can
+// survive a process restart. Implementations may write to disk, an object store, etc.
+type SnapshotStore interface {
+	Save(snap *Snapshot) error
+	Load() (*Snapshot, error)
+}
+
+// SetSnapshotStore wires a SnapshotStore so snapshots created or installed on this
+// node are persisted.
+func (n *Node) SetSnapshotStore(store SnapshotStore) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.snapshotStore = store
+}
+
+// CreateSnapshot records snap as the state machine's content as of index, which must
+// already have been applied, and compacts the log by discarding every entry up to and
+// including it - they are no longer needed once the state they represent is captured,
+// see §7.
+func (n *Node) CreateSnapshot(index uint64, snap []byte) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	idx := int(index)
+	if idx > n.lastApplied {
+		return fmt.Errorf("cannot snapshot index %v: only %v entries have been applied", idx, n.lastApplied)
+	}
+
+	entry, ok := n.replicatedLog.Get(idx)
+	if !ok {
+		return fmt.Errorf("cannot snapshot index %v: no such log entry", idx)
+	}
+
+	n.snapshot = &Snapshot{
+		LastIncludedIndex: idx,
+		LastIncludedTerm:  entry.Term,
+		StateMachineBytes: snap,
+		ClusterConfig:     n.configuration.ids(),
+	}
+	if n.snapshotStore != nil {
+		if err := n.snapshotStore.Save(n.snapshot); err != nil {
+			return err
+		}
+	}
+
+	n.replicatedLog.DiscardBefore(idx, entry.Term)
+	return nil
+}
+
+// InstallSnapshot as an RPC is now handled through Step (see stepInstallSnapshot in
+// step.go); the leader side of streaming one out lives in queueSnapshot/
+// sendSnapshotChunk, also in step.go. A snapshot installed from a leader is surfaced to
+// the caller's state machine on Ready's Snapshot field, not a dedicated channel - Step
+// must never block on a slow consumer, see signalReady.
@@ -8,6 +8,9 @@ type State int
 const (
 	// FOLLOWER is the start state.
 	FOLLOWER State = iota
+	// PRE_CANDIDATE probes the cluster for a pre-vote before committing to a real
+	// election, see etcd/raft's StatePreCandidate.
+	PRE_CANDIDATE
 	// CANDIDATE is the candidate state.
 	CANDIDATE
 	// LEADER is the leader state.
@@ -25,9 +28,10 @@ func NewStatemachine() *Statemachine {
 	s := new(Statemachine)
 	s.current = FOLLOWER
 	s.validTransitions = map[State][]State{
-		FOLLOWER:  []State{CANDIDATE},
-		CANDIDATE: []State{FOLLOWER, CANDIDATE, LEADER},
-		LEADER:    []State{FOLLOWER},
+		FOLLOWER:      []State{PRE_CANDIDATE},
+		PRE_CANDIDATE: []State{CANDIDATE, FOLLOWER},
+		CANDIDATE:     []State{FOLLOWER, CANDIDATE, LEADER},
+		LEADER:        []State{FOLLOWER},
 	}
 	return s
 }
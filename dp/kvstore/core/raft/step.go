@@ -0,0 +1,542 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Ready bundles everything a Step/Tick call produced that the caller must act on:
+// messages to deliver over the transport, entries to persist before acking them, and
+// entries now safe to apply to the state machine. A Snapshot is set once, the round a
+// snapshot was just installed from a leader.
+type Ready struct {
+	Messages         []Message
+	EntriesToPersist []LogEntry
+	EntriesToApply   []LogEntry
+	Snapshot         *Snapshot
+}
+
+// Ready returns the channel this Node publishes on whenever Step or Tick produced
+// outbound messages, entries to persist, or entries to apply. The transport - or a
+// test - drains it and feeds received Messages back in via Step.
+func (n *Node) Ready() <-chan Ready {
+	return n.readyCh
+}
+
+// Step is the single entry point for every message a Node receives, whether from a
+// peer or from the local clock (MsgTick). It never makes a network call or blocks on
+// one; anything it produces is queued for Ready. This keeps the raft algorithm itself
+// single-threaded and deterministic, and testable without goroutines or real RPC.
+func (n *Node) Step(m Message) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return nil
+	}
+
+	switch m.Type {
+	case MsgTick:
+		n.tick()
+	case MsgProp:
+		if n.isLeader() {
+			n.stepPropose(m.Command)
+		}
+	case MsgVote:
+		n.stepVote(m)
+	case MsgVoteResp:
+		n.stepVoteResp(m)
+	case MsgPreVote:
+		n.stepPreVote(m)
+	case MsgPreVoteResp:
+		n.stepPreVoteResp(m)
+	case MsgApp:
+		n.stepAppendEntries(m)
+	case MsgAppResp:
+		n.stepAppendEntriesResp(m)
+	case MsgHeartbeat:
+		n.stepHeartbeat(m)
+	case MsgHeartbeatResp:
+		n.stepHeartbeatResp(m)
+	case MsgSnap:
+		n.stepInstallSnapshot(m)
+	case MsgSnapResp:
+		n.stepSnapResp(m)
+	default:
+		return fmt.Errorf("raft: node %v received unknown message type %v", n.id, m.Type)
+	}
+
+	n.signalReady()
+	return nil
+}
+
+// Tick advances the logical clock by one tick. The caller (a transport loop, or a
+// test) drives this at a steady rate instead of Node running its own timers, which is
+// what makes Step deterministic and table-driven tests possible.
+func (n *Node) Tick() {
+	n.Step(Message{Type: MsgTick})
+}
+
+// tick handles one MsgTick: leaders send a heartbeat round every heartbeatTimeout
+// ticks, everyone else starts a new election once electionTimeout ticks pass without
+// hearing from a leader.
+func (n *Node) tick() {
+	if n.isLeader() {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.heartbeatTimeout {
+			n.heartbeatElapsed = 0
+			n.broadcastHeartbeat()
+		}
+		return
+	}
+
+	n.electionElapsed++
+	if n.electionElapsed < n.electionTimeout {
+		return
+	}
+	n.electionElapsed = 0
+	n.electionTimeout = 20 + rand.Intn(10) // re-jitter, so a split vote is not repeated every timeout
+
+	n.log("Election timout.")
+	if n.statemachine.Current() != FOLLOWER {
+		n.statemachine.Next(FOLLOWER) // abandon a stalled pre-vote/election and retry
+	}
+	n.startElectionProcess()
+}
+
+// send queues m for delivery on the next Ready.
+func (n *Node) send(m Message) {
+	n.outMessages = append(n.outMessages, m)
+}
+
+// signalReady drains the pending outbox/persist/apply queues into a Ready value and
+// publishes it, merging with whatever the channel already holds if the consumer
+// hasn't drained it yet - Step/Tick must never block on the caller's pace.
+func (n *Node) signalReady() {
+	if len(n.outMessages) == 0 && len(n.toPersist) == 0 && len(n.toApply) == 0 && n.pendingSnapshot == nil {
+		return
+	}
+
+	ready := Ready{
+		Messages:         n.outMessages,
+		EntriesToPersist: n.toPersist,
+		EntriesToApply:   n.toApply,
+		Snapshot:         n.pendingSnapshot,
+	}
+	n.outMessages = nil
+	n.toPersist = nil
+	n.toApply = nil
+	n.pendingSnapshot = nil
+
+	select {
+	case n.readyCh <- ready:
+	default:
+		select {
+		case prev := <-n.readyCh:
+			ready.Messages = append(prev.Messages, ready.Messages...)
+			ready.EntriesToPersist = append(prev.EntriesToPersist, ready.EntriesToPersist...)
+			ready.EntriesToApply = append(prev.EntriesToApply, ready.EntriesToApply...)
+			if ready.Snapshot == nil {
+				ready.Snapshot = prev.Snapshot
+			}
+		default:
+		}
+		n.readyCh <- ready
+	}
+}
+
+// onLeaderMessage applies the universal §5.1 rule: whoever has the higher term wins,
+// and anyone who isn't a FOLLOWER steps down on hearing from a legitimate leader.
+func (n *Node) onLeaderMessage(term int) {
+	if term < n.currentTerm {
+		return // a stale leader; the caller rejects its message
+	}
+	if term > n.currentTerm {
+		n.currentTerm = term
+	}
+	if n.isLeader() || n.isCandidate() || n.statemachine.Current() == PRE_CANDIDATE {
+		n.switchToFollower()
+	}
+}
+
+// stepPropose appends cmd to the log and queues it for persistence, returning its
+// index. advanceCommitIndex/applyCommitted are called right away too, the same as
+// stepAppendEntriesResp does on every replication ack - without that a single-node
+// (or otherwise self-quorate) leader would never commit or apply its own proposals,
+// since on the leader stepAppendEntriesResp is the only other place that calls them.
+func (n *Node) stepPropose(cmd string) int {
+	entry := LogEntry{Term: n.currentTerm, Index: n.replicatedLog.LastIndex() + 1, Command: cmd}
+	n.replicatedLog.Append(entry)
+	n.toPersist = append(n.toPersist, entry)
+	n.advanceCommitIndex()
+	n.applyCommitted()
+	return entry.Index
+}
+
+// =====================================================================================================================
+// Election messages
+// =====================================================================================================================
+
+// stepVote is called by candidates to gather votes.
+func (n *Node) stepVote(m Message) {
+	if m.Term < n.currentTerm {
+		n.send(Message{Type: MsgVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		if n.isCandidate() || n.isLeader() || n.statemachine.Current() == PRE_CANDIDATE {
+			n.switchToFollower()
+		}
+		n.votedFor = nil
+	}
+
+	n.electionElapsed = 0
+
+	if n.votedFor != nil && m.Term == n.currentTerm {
+		n.send(Message{Type: MsgVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	// §5.4.1 - only vote for a candidate whose log is at least as up-to-date as ours,
+	// or a leader elected without our committed entries could overwrite them.
+	logUpToDate := m.LogTerm > n.replicatedLog.LastTerm() ||
+		(m.LogTerm == n.replicatedLog.LastTerm() && m.LogIndex >= n.replicatedLog.LastIndex())
+	if !logUpToDate {
+		n.send(Message{Type: MsgVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	n.votedFor = &m.From
+	n.log(fmt.Sprintf("RequestVote received from Candidate %v. Vote OK.", m.From))
+	n.send(Message{Type: MsgVoteResp, From: n.id, To: m.From, Term: n.currentTerm})
+}
+
+// stepVoteResp counts one real vote toward the election this node is running.
+func (n *Node) stepVoteResp(m Message) {
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		n.switchToFollower()
+		return
+	}
+	if !n.isCandidate() || m.Reject {
+		return
+	}
+
+	n.votesGranted[m.From] = true
+	n.maybeWinElection()
+}
+
+// maybeWinElection switches to leader once votesGranted (plus this node's own,
+// implicit vote, see hasQuorum) forms a majority. Called both from stepVoteResp as
+// votes trickle in and right after broadcastVoteRequests, so a candidate that is
+// already its own majority - a single-node configuration, or one reduced to it by a
+// joint-consensus ConfChange - wins without waiting on any remote reply.
+func (n *Node) maybeWinElection() {
+	if !n.hasQuorum(n.votesGranted) {
+		return
+	}
+
+	n.log("Election won. Now acting as leader.")
+	n.switchToLeader()
+}
+
+// stepPreVote is called by a node in PRE_CANDIDATE state to check, before it bumps its
+// own term and disrupts the cluster, whether it could actually win a real election.
+// Granting a pre-vote does NOT persist votedFor and does NOT bump currentTerm.
+func (n *Node) stepPreVote(m Message) {
+	// A pre-vote is only granted once we have not heard from a *known* leader for at
+	// least an election timeout - otherwise we would help a partitioned node disrupt a
+	// healthy leader. A node that has never seen a leader at all (leaderID == nil, e.g.
+	// the very first election of a fresh cluster) has nothing to protect and always
+	// grants. Ticks, not wall-clock time, are what electionElapsed counts (see tick()),
+	// keeping this deterministic and table-test-friendly like the rest of Step.
+	if n.leaderID != nil && n.electionElapsed < n.electionTimeout {
+		n.send(Message{Type: MsgPreVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+	if m.Term < n.currentTerm {
+		n.send(Message{Type: MsgPreVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	logUpToDate := m.LogTerm > n.replicatedLog.LastTerm() ||
+		(m.LogTerm == n.replicatedLog.LastTerm() && m.LogIndex >= n.replicatedLog.LastIndex())
+	if !logUpToDate {
+		n.send(Message{Type: MsgPreVoteResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	n.log(fmt.Sprintf("RequestPreVote received from Candidate %v. Pre-vote OK.", m.From))
+	n.send(Message{Type: MsgPreVoteResp, From: n.id, To: m.From, Term: n.currentTerm})
+}
+
+// stepPreVoteResp counts one pre-vote; once a majority is granted, the node commits
+// to a real election by bumping currentTerm and broadcasting MsgVote.
+func (n *Node) stepPreVoteResp(m Message) {
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		n.switchToFollower()
+		return
+	}
+	if n.statemachine.Current() != PRE_CANDIDATE || m.Reject {
+		return
+	}
+
+	n.preVotesGranted[m.From] = true
+	n.maybeWinPreVote()
+}
+
+// maybeWinPreVote commits to a real election once preVotesGranted (plus this node's
+// own implicit pre-vote, see hasQuorum) forms a majority, then immediately checks
+// whether the vote it just broadcast was also already won - see maybeWinElection.
+func (n *Node) maybeWinPreVote() {
+	if !n.hasQuorum(n.preVotesGranted) {
+		return
+	}
+
+	n.log("<- PreVote: true")
+	n.currentTerm++ // new term starts now -> see 5.2
+	n.statemachine.Next(CANDIDATE)
+	n.votedFor = &n.id
+	n.votesGranted = make(map[int]bool)
+	n.broadcastVoteRequests()
+	n.maybeWinElection()
+}
+
+// =====================================================================================================================
+// Replication messages
+// =====================================================================================================================
+
+// stepAppendEntries implements AppendEntries' receiver behaviour: heartbeat and log
+// replication.
+func (n *Node) stepAppendEntries(m Message) {
+	n.onLeaderMessage(m.Term)
+
+	if m.Term < n.currentTerm {
+		n.send(Message{Type: MsgAppResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return // §5.1
+	}
+
+	n.electionElapsed = 0
+	n.leaderID = &m.From
+
+	// §5.3 - reject unless our log contains an entry at prevLogIndex matching prevLogTerm.
+	if m.LogIndex > 0 {
+		existing, ok := n.replicatedLog.Get(m.LogIndex)
+		if !ok || existing.Term != m.LogTerm {
+			n.send(Message{Type: MsgAppResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+			return
+		}
+	}
+
+	for _, entry := range m.Entries {
+		existing, ok := n.replicatedLog.Get(entry.Index)
+		if ok && existing.Term != entry.Term {
+			// conflicting entry - §5.3 says delete it and everything after it.
+			n.replicatedLog.Truncate(entry.Index)
+			ok = false
+		}
+		if !ok {
+			n.replicatedLog.Append(entry)
+		}
+	}
+	if len(m.Entries) > 0 {
+		n.log(fmt.Sprintf("[%v] AppendEntries replicated %v entries on Node: %v", n.statemachine.Current(), len(m.Entries), n.id))
+		n.recomputeConfiguration() // adopt (or revert, if truncated away) any ConfChange just appended
+	}
+
+	if m.Commit > n.commitIndex {
+		lastNewIndex := m.LogIndex + len(m.Entries)
+		if m.Commit < lastNewIndex {
+			n.commitIndex = m.Commit
+		} else {
+			n.commitIndex = lastNewIndex
+		}
+		n.applyCommitted()
+	}
+
+	n.send(Message{Type: MsgAppResp, From: n.id, To: m.From, Term: n.currentTerm, LogIndex: m.LogIndex + len(m.Entries), ReadSeq: m.ReadSeq})
+}
+
+// stepAppendEntriesResp is the leader side of AppendEntries: advance nextIndex/
+// matchIndex on success, back off and retry on rejection (see §5.3).
+func (n *Node) stepAppendEntriesResp(m Message) {
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		n.switchToFollower()
+		return
+	}
+	if !n.isLeader() {
+		return
+	}
+
+	if m.Reject {
+		if n.nextIndex[m.From] > 1 {
+			n.nextIndex[m.From]--
+			n.sendAppendOrSnapshot(m.From, 0) // retry right away with a lower nextIndex
+		}
+		return
+	}
+
+	if m.LogIndex > n.matchIndex[m.From] {
+		n.matchIndex[m.From] = m.LogIndex
+		n.nextIndex[m.From] = m.LogIndex + 1
+	}
+	n.advanceCommitIndex()
+	n.applyCommitted()
+	n.ackRead(m.From, m.ReadSeq)
+}
+
+// stepHeartbeat is the receiver side of a heartbeat-only AppendEntries: it never
+// carries entries, only a fresh commitIndex to apply up to.
+func (n *Node) stepHeartbeat(m Message) {
+	n.onLeaderMessage(m.Term)
+
+	if m.Term < n.currentTerm {
+		n.send(Message{Type: MsgHeartbeatResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	n.electionElapsed = 0
+	n.leaderID = &m.From
+
+	// Commit only up to prevLogIndex, and only if our log matches the leader's there
+	// (§5.3); an index at or before our snapshot is already committed, so it matches.
+	prev, ok := n.replicatedLog.Get(m.LogIndex)
+	matched := m.LogIndex < n.replicatedLog.FirstIndex() || (ok && prev.Term == m.LogTerm)
+	if matched && m.Commit > n.commitIndex && m.LogIndex > n.commitIndex {
+		n.commitIndex = m.Commit
+		if m.LogIndex < m.Commit {
+			n.commitIndex = m.LogIndex
+		}
+		n.applyCommitted()
+	}
+
+	n.send(Message{Type: MsgHeartbeatResp, From: n.id, To: m.From, Term: n.currentTerm, ReadSeq: m.ReadSeq})
+}
+
+// stepHeartbeatResp only matters for ReadIndex: it proves the leader was still leader
+// for this follower at the start of the round.
+func (n *Node) stepHeartbeatResp(m Message) {
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		n.switchToFollower()
+		return
+	}
+	if !n.isLeader() || m.Reject {
+		return
+	}
+	n.ackRead(m.From, m.ReadSeq)
+}
+
+// =====================================================================================================================
+// Snapshot messages
+// =====================================================================================================================
+
+// snapshotChunkSize bounds how much of a Snapshot is streamed per MsgSnap message.
+const snapshotChunkSize = 64 * 1024
+
+// queueSnapshot starts (or resumes) streaming n.snapshot to follower from wherever it
+// left off.
+func (n *Node) queueSnapshot(follower int) {
+	if n.snapshotOffset == nil {
+		n.snapshotOffset = make(map[int]int)
+	}
+	n.sendSnapshotChunk(follower, n.snapshotOffset[follower])
+}
+
+// sendSnapshotChunk queues bytes [offset:offset+snapshotChunkSize) of n.snapshot to follower.
+func (n *Node) sendSnapshotChunk(follower, offset int) {
+	data := n.snapshot.StateMachineBytes
+	end := offset + snapshotChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	done := end >= len(data)
+
+	msg := Message{
+		Type: MsgSnap, From: n.id, To: follower, Term: n.currentTerm,
+		LogIndex: n.snapshot.LastIncludedIndex, LogTerm: n.snapshot.LastIncludedTerm,
+		Data: data[offset:end], Offset: offset, Done: done,
+	}
+	if done {
+		msg.ClusterConfig = n.snapshot.ClusterConfig
+	}
+	n.send(msg)
+}
+
+// stepInstallSnapshot is sent by a leader to a follower whose nextIndex has fallen
+// behind the leader's log start, i.e. the entries it would need have already been
+// compacted away. Once the final chunk arrives, the follower replaces its state
+// machine and discards its whole log, including any entries after the snapshot's
+// LastIncludedIndex, and resets its election timer, as it would for any message from
+// a legitimate leader.
+func (n *Node) stepInstallSnapshot(m Message) {
+	n.onLeaderMessage(m.Term)
+
+	if m.Term < n.currentTerm {
+		n.send(Message{Type: MsgSnapResp, From: n.id, To: m.From, Term: n.currentTerm, Reject: true})
+		return
+	}
+
+	n.electionElapsed = 0
+	n.leaderID = &m.From
+
+	n.inboundSnapshot = append(n.inboundSnapshot, m.Data...)
+	if !m.Done {
+		n.send(Message{Type: MsgSnapResp, From: n.id, To: m.From, Term: n.currentTerm})
+		return
+	}
+
+	snap := &Snapshot{LastIncludedIndex: m.LogIndex, LastIncludedTerm: m.LogTerm, StateMachineBytes: n.inboundSnapshot, ClusterConfig: m.ClusterConfig}
+	n.inboundSnapshot = nil
+	n.snapshot = snap
+	if n.snapshotStore != nil {
+		n.snapshotStore.Save(snap) // best effort: the in-memory snapshot is still authoritative
+	}
+
+	n.replicatedLog.Reset(snap.LastIncludedIndex, snap.LastIncludedTerm)
+	n.commitIndex = snap.LastIncludedIndex
+	n.lastApplied = snap.LastIncludedIndex
+	if len(snap.ClusterConfig) > 0 {
+		n.baseConfiguration = newConfiguration(snap.ClusterConfig)
+		n.configuration = n.baseConfiguration
+		n.jointOld = nil
+		n.confChangeIndex = 0
+		n.pendingChange = nil
+	}
+	n.pendingSnapshot = snap
+
+	n.send(Message{Type: MsgSnapResp, From: n.id, To: m.From, Term: n.currentTerm, LogIndex: snap.LastIncludedIndex})
+}
+
+// stepSnapResp is the leader side of InstallSnapshot: send the next chunk, or once the
+// follower has acked the final one, resume normal replication from the snapshot's end.
+func (n *Node) stepSnapResp(m Message) {
+	if m.Term > n.currentTerm {
+		n.currentTerm = m.Term
+		n.switchToFollower()
+		return
+	}
+	if !n.isLeader() || m.Reject || n.snapshot == nil {
+		return
+	}
+
+	if n.snapshotOffset == nil {
+		n.snapshotOffset = make(map[int]int)
+	}
+	nextOffset := n.snapshotOffset[m.From] + snapshotChunkSize
+	if nextOffset < len(n.snapshot.StateMachineBytes) {
+		n.snapshotOffset[m.From] = nextOffset
+		n.sendSnapshotChunk(m.From, nextOffset)
+		return
+	}
+
+	delete(n.snapshotOffset, m.From)
+	n.matchIndex[m.From] = n.snapshot.LastIncludedIndex
+	n.nextIndex[m.From] = n.snapshot.LastIncludedIndex + 1
+}
@@ -0,0 +1,492 @@
+// Copyright 2018 Johannes Weigend
+// Licensed under the Apache License, Version 2.0
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// newTestCluster builds n nodes wired to each other via a Cluster, started the same
+// way a real transport would, but never ticked or stepped automatically - that is
+// entirely up to the test, which is the point of driving raft through Step/Tick.
+func newTestCluster(n int) map[int]*Node {
+	addrs := make(map[int]string, n)
+	for i := 0; i < n; i++ {
+		addrs[i] = "node"
+	}
+	cluster := NewCluster(addrs)
+
+	nodes := make(map[int]*Node, n)
+	for i := 0; i < n; i++ {
+		nodes[i] = NewNode(i)
+		nodes[i].Start(cluster)
+	}
+	return nodes
+}
+
+// deliverAll drains every node's Ready, delivering outbound Messages to their
+// recipient's Step and draining whatever that produced in turn, until no node has
+// anything left to send - the transport loop's job, done synchronously so tests stay
+// deterministic. Every EntriesToApply seen along the way is appended to applied, keyed
+// by node id, so a test can observe what got committed without a race against this
+// draining.
+func deliverAll(nodes map[int]*Node, applied map[int][]LogEntry) {
+	drain := func(id int) []Message {
+		select {
+		case ready := <-nodes[id].Ready():
+			applied[id] = append(applied[id], ready.EntriesToApply...)
+			return ready.Messages
+		default:
+			return nil
+		}
+	}
+
+	var queue []Message
+	for id := range nodes {
+		queue = append(queue, drain(id)...)
+	}
+
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		nodes[m.To].Step(m)
+		queue = append(queue, drain(m.To)...)
+	}
+}
+
+// tickAll advances every node's logical clock by one tick and delivers whatever that
+// produced.
+func tickAll(nodes map[int]*Node, applied map[int][]LogEntry) {
+	for _, n := range nodes {
+		n.Tick()
+	}
+	deliverAll(nodes, applied)
+}
+
+func leaderOf(nodes map[int]*Node) (int, bool) {
+	for id, n := range nodes {
+		if n.isLeader() {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// TestElectionConvergesViaStepAndTick drives a 3-node cluster purely through Step and
+// Tick - no goroutines, no real RPC - and checks a single leader emerges. Which node
+// wins depends on each node's randomized electionTimeout.
+func TestElectionConvergesViaStepAndTick(t *testing.T) {
+	nodes := newTestCluster(3)
+	applied := make(map[int][]LogEntry)
+
+	const maxTicks = 50
+	elected := -1
+	for i := 0; i < maxTicks; i++ {
+		tickAll(nodes, applied)
+		if id, ok := leaderOf(nodes); ok {
+			elected = id
+			break
+		}
+	}
+
+	if elected == -1 {
+		t.Fatalf("no leader elected within %v ticks", maxTicks)
+	}
+
+	leaders := 0
+	for _, n := range nodes {
+		if n.isLeader() {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("expected exactly one leader, got %v", leaders)
+	}
+}
+
+// TestProposeReplicatesAndCommits drives a 3-node cluster to a leader, proposes one
+// command, and checks every node eventually applies it at the same index.
+func TestProposeReplicatesAndCommits(t *testing.T) {
+	nodes := newTestCluster(3)
+	applied := make(map[int][]LogEntry)
+
+	var leader int
+	for i := 0; i < 50; i++ {
+		tickAll(nodes, applied)
+		if id, ok := leaderOf(nodes); ok {
+			leader = id
+			break
+		}
+	}
+	if !nodes[leader].isLeader() {
+		t.Fatalf("setup: no leader elected")
+	}
+
+	index, err := nodes[leader].Propose("set x=1")
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	deliverAll(nodes, applied)
+
+	allApplied := func() bool {
+		for id := range nodes {
+			if len(applied[id]) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 30 && !allApplied(); i++ {
+		tickAll(nodes, applied)
+	}
+
+	for id := range nodes {
+		entries := applied[id]
+		if len(entries) == 0 {
+			t.Fatalf("node %v never applied the proposed entry", id)
+		}
+		last := entries[len(entries)-1]
+		if last.Index != index || last.Command != "set x=1" {
+			t.Fatalf("node %v applied %+v, want index %v command %q", id, last, index, "set x=1")
+		}
+	}
+}
+
+// TestStepVoteRejectsStaleLog covers §5.4.1: a candidate whose log is behind the
+// voter's must not receive its vote, even though nothing else disqualifies it.
+func TestStepVoteRejectsStaleLog(t *testing.T) {
+	voter := NewNode(1)
+	voter.replicatedLog.Append(LogEntry{Term: 2, Index: 1})
+
+	voter.Step(Message{Type: MsgVote, From: 2, To: 1, Term: 3, LogIndex: 0, LogTerm: 1})
+
+	ready := <-voter.Ready()
+	if len(ready.Messages) != 1 {
+		t.Fatalf("expected exactly one MsgVoteResp, got %v", ready.Messages)
+	}
+	resp := ready.Messages[0]
+	if resp.Type != MsgVoteResp || !resp.Reject {
+		t.Fatalf("expected a rejected MsgVoteResp for a stale candidate log, got %+v", resp)
+	}
+	if voter.votedFor != nil {
+		t.Fatalf("voter must not record votedFor when rejecting on log currency, got %v", *voter.votedFor)
+	}
+}
+
+// TestSingleNodeClusterElectsAndCommits covers the regression where election quorum
+// was only ever checked inside the response handlers (stepPreVoteResp/stepVoteResp),
+// never right after broadcasting - so a cluster with zero remote followers, including
+// one a joint-consensus ConfChange shrinks down to, could never win a pre-vote or
+// vote and would livelock in FOLLOWER/PRE_CANDIDATE forever. It also covers
+// stepPropose calling advanceCommitIndex/applyCommitted itself, since a solo leader
+// has no stepAppendEntriesResp to do it for it.
+func TestSingleNodeClusterElectsAndCommits(t *testing.T) {
+	nodes := newTestCluster(1)
+	applied := make(map[int][]LogEntry)
+
+	elected := false
+	for i := 0; i < nodes[0].electionTimeout+1 && !elected; i++ {
+		tickAll(nodes, applied)
+		elected = nodes[0].isLeader()
+	}
+	if !elected {
+		t.Fatalf("single-node cluster never elected itself leader")
+	}
+
+	index, err := nodes[0].Propose("set x=1")
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	deliverAll(nodes, applied)
+
+	entries := applied[0]
+	if len(entries) == 0 {
+		t.Fatalf("single-node leader never committed/applied its own proposal")
+	}
+	last := entries[len(entries)-1]
+	if last.Index != index || last.Command != "set x=1" {
+		t.Fatalf("applied %+v, want index %v command %q", last, index, "set x=1")
+	}
+}
+
+// TestAckReadRequiresPerConfigurationMajority covers chunk0-3's Safe ReadIndex proof
+// during a chunk0-6 joint-consensus reconfiguration: a round must be satisfied by a
+// majority of Cold AND a majority of Cnew independently (the same rule hasQuorum
+// applies to elections and commits), not a combined ack count against the larger of
+// the two quorum sizes - that would let acks from Cold's members alone, with none
+// from any member only in Cnew, wrongly satisfy the round.
+func TestAckReadRequiresPerConfigurationMajority(t *testing.T) {
+	leader := NewNode(1)
+	leader.statemachine.Next(PRE_CANDIDATE)
+	leader.statemachine.Next(CANDIDATE)
+	leader.statemachine.Next(LEADER)
+	leader.jointOld = newConfiguration([]int{1, 2, 3})
+	leader.configuration = newConfiguration([]int{1, 4, 5, 6, 7})
+
+	read := pendingRead{index: 1, resultCh: make(chan uint64, 1)}
+	leader.readsBySeq = map[int][]pendingRead{1: {read}}
+	leader.readAcks = map[int]map[int]bool{1: {}}
+
+	leader.ackRead(2, 1)
+	leader.ackRead(3, 1)
+	select {
+	case <-read.resultCh:
+		t.Fatalf("round satisfied by acks from Cold alone ({1,2,3}), which is not a majority of Cnew {1,4,5,6,7}")
+	default:
+	}
+
+	leader.ackRead(4, 1)
+	select {
+	case <-read.resultCh:
+		t.Fatalf("round satisfied before a majority of Cnew ({1,4,5,6,7}) acked")
+	default:
+	}
+
+	leader.ackRead(5, 1)
+	select {
+	case <-read.resultCh:
+	default:
+		t.Fatalf("round never satisfied once a majority of both Cold and Cnew acked")
+	}
+}
+
+// TestReadIndexResolvesWithoutRemoteFollowers covers the regression where ReadIndex
+// on a single-node cluster (or one a joint-consensus RemoveNode shrinks to) would
+// queue a pendingRead and block forever: broadcastHeartbeat tags a round onto an empty
+// remoteFollowerIDs() loop, so ackRead - the only thing that used to check hasQuorum -
+// was never called, even though the leader was already its own majority the instant
+// the round was tagged. ReadIndex now checks hasQuorum itself before ever queuing.
+func TestReadIndexResolvesWithoutRemoteFollowers(t *testing.T) {
+	nodes := newTestCluster(1)
+	applied := make(map[int][]LogEntry)
+
+	elected := false
+	for i := 0; i < nodes[0].electionTimeout+1 && !elected; i++ {
+		tickAll(nodes, applied)
+		elected = nodes[0].isLeader()
+	}
+	if !elected {
+		t.Fatalf("single-node cluster never elected itself leader")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := nodes[0].ReadIndex(ctx)
+	if err != nil {
+		t.Fatalf("ReadIndex: %v", err)
+	}
+	if index != uint64(nodes[0].commitIndex) {
+		t.Fatalf("ReadIndex returned %v, want the current commitIndex %v", index, nodes[0].commitIndex)
+	}
+}
+
+// TestInstallSnapshotStreamsToFollowerBehindFirstIndex covers chunk0-4: once the
+// leader compacts its log past a follower's nextIndex, sendAppendOrSnapshot must fall
+// back to streaming a Snapshot via MsgSnap chunks (queueSnapshot/sendSnapshotChunk/
+// stepInstallSnapshot/stepSnapResp) instead of an ordinary MsgApp, and the follower
+// must end up with the installed snapshot's state and a log anchored right after it.
+func TestInstallSnapshotStreamsToFollowerBehindFirstIndex(t *testing.T) {
+	nodes := newTestCluster(3)
+	applied := make(map[int][]LogEntry)
+
+	var leader int
+	for i := 0; i < 50; i++ {
+		tickAll(nodes, applied)
+		if id, ok := leaderOf(nodes); ok {
+			leader = id
+			break
+		}
+	}
+	if !nodes[leader].isLeader() {
+		t.Fatalf("setup: no leader elected")
+	}
+
+	var stale int
+	for id := range nodes {
+		if id != leader {
+			stale = id
+			break
+		}
+	}
+
+	// Simulate the stale follower being offline: messages addressed to it are dropped
+	// and it is never ticked, so the leader and its one remaining follower replicate
+	// and commit entries the stale follower never sees.
+	active := make(map[int]*Node, 2)
+	for id, n := range nodes {
+		if id != stale {
+			active[id] = n
+		}
+	}
+	drainActive := func(id int) []Message {
+		select {
+		case ready := <-active[id].Ready():
+			applied[id] = append(applied[id], ready.EntriesToApply...)
+			return ready.Messages
+		default:
+			return nil
+		}
+	}
+	deliverActive := func() {
+		var queue []Message
+		for id := range active {
+			queue = append(queue, drainActive(id)...)
+		}
+		for len(queue) > 0 {
+			m := queue[0]
+			queue = queue[1:]
+			if recipient, ok := active[m.To]; ok {
+				recipient.Step(m)
+				queue = append(queue, drainActive(m.To)...)
+			}
+		}
+	}
+	tickActive := func() {
+		for _, n := range active {
+			n.Tick()
+		}
+		deliverActive()
+	}
+
+	var lastIndex int
+	for i := 0; i < 5; i++ {
+		index, err := nodes[leader].Propose(fmt.Sprintf("set x=%v", i))
+		if err != nil {
+			t.Fatalf("Propose: %v", err)
+		}
+		lastIndex = index
+	}
+	deliverActive()
+	for i := 0; i < 30 && len(applied[leader]) < 5; i++ {
+		tickActive()
+	}
+	if len(applied[leader]) < 5 {
+		t.Fatalf("leader and its one live follower never committed all 5 proposals while the stale follower was offline")
+	}
+
+	if err := nodes[leader].CreateSnapshot(uint64(lastIndex), []byte("snapshot-state")); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if nodes[leader].replicatedLog.FirstIndex() <= lastIndex {
+		t.Fatalf("CreateSnapshot did not compact the log past index %v, FirstIndex is %v", lastIndex, nodes[leader].replicatedLog.FirstIndex())
+	}
+
+	// Bring the stale follower back: its nextIndex is long gone from the leader's
+	// compacted log, so the next replication attempt must stream a snapshot.
+	for i := 0; i < 30 && nodes[stale].snapshot == nil; i++ {
+		tickAll(nodes, applied)
+	}
+
+	if nodes[stale].snapshot == nil {
+		t.Fatalf("stale follower never installed a snapshot")
+	}
+	if nodes[stale].snapshot.LastIncludedIndex != lastIndex {
+		t.Fatalf("stale follower installed a snapshot at index %v, want %v", nodes[stale].snapshot.LastIncludedIndex, lastIndex)
+	}
+	if nodes[stale].replicatedLog.FirstIndex() != lastIndex+1 {
+		t.Fatalf("stale follower's log was not reset to right after the installed snapshot, FirstIndex is %v", nodes[stale].replicatedLog.FirstIndex())
+	}
+}
+
+// configHasExactly reports whether cfg's members are exactly ids, for checking a
+// joint-consensus reconfiguration landed on the expected Cnew.
+func configHasExactly(cfg *Configuration, ids []int) bool {
+	if len(cfg.Members) != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		if _, ok := cfg.Members[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// TestProposeConfChangeRemovesLeaderThroughJointConsensus covers chunk0-6 end to end:
+// the leader proposes removing itself, the cluster carries the reconfiguration through
+// its joint (Cold,new) phase to the Cnew-only entry (see ProposeConfChange/
+// maybeAdvanceConfChange), and only once that final entry commits does the leader step
+// down - the corner case §6 warns a premature step-down could strand the cluster
+// without a leader.
+func TestProposeConfChangeRemovesLeaderThroughJointConsensus(t *testing.T) {
+	nodes := newTestCluster(3)
+	applied := make(map[int][]LogEntry)
+
+	var leader int
+	for i := 0; i < 50; i++ {
+		tickAll(nodes, applied)
+		if id, ok := leaderOf(nodes); ok {
+			leader = id
+			break
+		}
+	}
+	if !nodes[leader].isLeader() {
+		t.Fatalf("setup: no leader elected")
+	}
+
+	var remaining []int
+	for id := range nodes {
+		if id != leader {
+			remaining = append(remaining, id)
+		}
+	}
+
+	if _, err := nodes[leader].ProposeConfChange(ConfChange{Type: RemoveNode, ID: leader}); err != nil {
+		t.Fatalf("ProposeConfChange: %v", err)
+	}
+	if nodes[leader].jointOld == nil {
+		t.Fatalf("ProposeConfChange did not enter the joint (Cold,new) phase")
+	}
+
+	for i := 0; i < 30 && nodes[leader].isLeader(); i++ {
+		tickAll(nodes, applied)
+	}
+
+	if nodes[leader].isLeader() {
+		t.Fatalf("leader never stepped down after the Cnew entry removing it committed")
+	}
+	if nodes[leader].statemachine.Current() != FOLLOWER {
+		t.Fatalf("removed leader ended in state %v, want FOLLOWER", nodes[leader].statemachine.Current())
+	}
+
+	for _, id := range remaining {
+		if nodes[id].jointOld != nil {
+			t.Fatalf("node %v still has a joint configuration in effect, want the joint phase finished", id)
+		}
+		if nodes[id].confChangeIndex != 0 {
+			t.Fatalf("node %v still has a ConfChange in flight, want none", id)
+		}
+		if !configHasExactly(nodes[id].configuration, remaining) {
+			t.Fatalf("node %v ended with configuration %v, want exactly %v", id, nodes[id].configuration.ids(), remaining)
+		}
+	}
+}
+
+// TestStepPreVoteRejectsWithinKnownLeadersTimeout covers the tick-counted floor
+// stepPreVote enforces once a leader is known: a pre-vote must be rejected if this
+// node has heard from that leader within its own election timeout, the same guard
+// that protects a healthy leader from a partitioned node's repeated term bumps. Before
+// the fix this floor was a wall-clock time.Since(lastHeartbeat) check seeded from the
+// zero time.Time, which never actually rejected anything in a table-driven test.
+func TestStepPreVoteRejectsWithinKnownLeadersTimeout(t *testing.T) {
+	voter := NewNode(1)
+	voter.Start(NewCluster(map[int]string{1: "node", 2: "node"}))
+
+	voter.Step(Message{Type: MsgHeartbeat, From: 2, To: 1, Term: 1})
+	<-voter.Ready()
+
+	voter.Step(Message{Type: MsgPreVote, From: 3, To: 1, Term: 2})
+
+	ready := <-voter.Ready()
+	if len(ready.Messages) != 1 {
+		t.Fatalf("expected exactly one MsgPreVoteResp, got %v", ready.Messages)
+	}
+	resp := ready.Messages[0]
+	if resp.Type != MsgPreVoteResp || !resp.Reject {
+		t.Fatalf("expected a rejected MsgPreVoteResp while within the known leader's election timeout, got %+v", resp)
+	}
+}